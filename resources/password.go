@@ -19,20 +19,27 @@ package resources
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/big"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/purpleidea/mgmt/etcd"
 	"github.com/purpleidea/mgmt/event"
 	"github.com/purpleidea/mgmt/recwatch"
 
+	etcdClient "github.com/coreos/etcd/clientv3"
 	errwrap "github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
 func init() {
@@ -44,6 +51,18 @@ const (
 	newline  = "\n" // something not in alphabet that TrimSpace can trim
 )
 
+// defaultMasterKeyPath is where the cluster-wide password encryption secret
+// is gossipped in etcd, unless a resource overrides it with KeySource.
+const defaultMasterKeyPath = "/secrets/password-master"
+
+// masterKeySize is the size in bytes of the cluster-wide master secret.
+const masterKeySize = 32
+
+// hkdfInfo labels keys derived for at-rest password encryption, so they
+// can't be confused with a key derived from the same master secret for a
+// different purpose.
+const hkdfInfo = "mgmt-password-res-v1"
+
 // PasswordRes is a no-op resource that returns a random password string.
 type PasswordRes struct {
 	BaseRes `yaml:",inline"`
@@ -53,8 +72,72 @@ type PasswordRes struct {
 	CheckRecovery bool    // recovery from integrity checks by re-generating
 	Password      *string // the generated password, read only, do not set!
 
-	path       string // the path to local storage
-	recWatcher *recwatch.RecWatcher
+	// Encrypted stores the saved token at rest, encrypted with a key
+	// derived from a cluster-wide secret instead of in the clear.
+	Encrypted bool `yaml:"encrypted"`
+	// KeySource is the etcd path the cluster-wide master secret is
+	// gossipped under. If empty, defaultMasterKeyPath is used.
+	KeySource string `yaml:"keysource"`
+	// Shared coordinates this password through etcd instead of generating
+	// it locally, so every node managing a PasswordRes with the same Name
+	// converges on the same value. This deliberately does not back the
+	// shared key with an etcd lease: a lease would expire (and delete the
+	// password) if the node that created it went away, which is the
+	// opposite of what a cluster-wide secret needs -- it must outlive any
+	// single node. Rotation is driven entirely by sharedChangeCallback's
+	// watch plus coordinateShared's Txn-gated write, not by lease expiry.
+	Shared bool `yaml:"shared"`
+	// EmbdEtcd is the handle used to fetch and publish the cluster-wide
+	// encryption secret, and to coordinate Shared passwords. Required
+	// when Encrypted or Shared is true; set by whatever wires this
+	// resource into the running cluster, not via yaml.
+	EmbdEtcd *etcd.EmbdEtcd
+
+	path         string // the path to local storage
+	recWatcher   *recwatch.RecWatcher
+	migrate      bool // obj.path held a plaintext token we need to re-encrypt
+	sharedCancel func()
+	sharedChan   chan struct{} // pinged when another node rotates the shared password
+
+	// passwordMu guards Password, migrate, and every write to obj.path:
+	// sharedChangeCallback adopts a rotated password (and, when Saved,
+	// writes it to disk, clearing migrate) from the etcd watcher's own goroutine,
+	// concurrently with CheckApply reading, writing, and persisting it
+	// from the engine's goroutine.
+	passwordMu sync.Mutex
+}
+
+// setPassword atomically updates Password and, if write is true, persists
+// value to disk, so a concurrent reader never observes Password pointing at
+// a value that hasn't made it to disk yet (or vice versa).
+func (obj *PasswordRes) setPassword(value string, write bool) error {
+	obj.passwordMu.Lock()
+	defer obj.passwordMu.Unlock()
+	obj.Password = &value
+	if !write {
+		return nil
+	}
+	_, err := obj.write(value)
+	return err
+}
+
+// getPassword returns the in-memory password, or nil if none has been set
+// yet.
+func (obj *PasswordRes) getPassword() *string {
+	obj.passwordMu.Lock()
+	defer obj.passwordMu.Unlock()
+	return obj.Password
+}
+
+// writeToken persists value to obj.path under passwordMu, so a caller that
+// needs to write something other than the in-memory Password (CheckApply's
+// token write, which may write an empty token even though Password is set)
+// still can't race sharedChangeCallback's setPassword write to the same
+// path.
+func (obj *PasswordRes) writeToken(value string) (int, error) {
+	obj.passwordMu.Lock()
+	defer obj.passwordMu.Unlock()
+	return obj.write(value)
 }
 
 // NewPasswordRes is a constructor for this resource. It also calls Init() for you.
@@ -79,9 +162,51 @@ func (obj *PasswordRes) Init() error {
 	}
 	obj.path = path.Join(dir, "password") // return a unique file
 
+	if obj.Shared {
+		if obj.EmbdEtcd == nil {
+			return fmt.Errorf("Shared requires EmbdEtcd to be set")
+		}
+		obj.sharedChan = make(chan struct{}, 1)
+		obj.sharedCancel, err = obj.EmbdEtcd.AddWatcher(obj.sharedKey(), obj.sharedChangeCallback, false, true)
+		if err != nil {
+			return errwrap.Wrapf(err, "could not watch shared password")
+		}
+	}
+
 	return obj.BaseRes.Init() // call base init, b/c we're overriding
 }
 
+// sharedKey is the etcd path this resource's shared password lives at.
+func (obj *PasswordRes) sharedKey() string {
+	return fmt.Sprintf("/secrets/passwords/%s", obj.Name)
+}
+
+// sharedChangeCallback fires when another node rotates the shared password.
+// It adopts the new value locally and pings Watch so it can reconverge.
+func (obj *PasswordRes) sharedChangeCallback(re *etcd.RE) error {
+	if re.Error() != nil {
+		return nil
+	}
+
+	for _, event := range re.Response().Events {
+		if event.Type != etcdClient.EventTypePut {
+			continue
+		}
+		value := string(event.Kv.Value)
+		// only a Saved password is cached on disk; otherwise the token
+		// file stays empty
+		if err := obj.setPassword(value, obj.Saved); err != nil {
+			log.Printf("%s[%s]: could not save rotated password: %s", obj.Kind(), obj.GetName(), err.Error())
+		}
+		select {
+		case obj.sharedChan <- struct{}{}:
+		default: // a reconverge is already pending
+		}
+	}
+
+	return nil
+}
+
 // Validate if the params passed in are valid data.
 // FIXME: where should this get called ?
 func (obj *PasswordRes) Validate() error {
@@ -98,7 +223,31 @@ func (obj *PasswordRes) read() (string, error) {
 	if err != nil {
 		return "", errwrap.Wrapf(err, "could not read from file")
 	}
-	return strings.TrimSpace(string(data)), nil
+
+	// an empty token is stored as a bare newline and is never encrypted
+	if !obj.Encrypted || strings.TrimSpace(string(data)) == "" {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	key, err := obj.resourceKey()
+	if err != nil {
+		return "", err
+	}
+	if plain, err := decryptToken(key, data); err == nil {
+		return strings.TrimSpace(plain), nil
+	}
+
+	// might be a plaintext token left over from before Encrypted was set;
+	// only treat it as one if it actually looks like a valid password, so
+	// real corruption still surfaces as a decrypt failure below.
+	raw := strings.TrimSpace(string(data))
+	if obj.check(raw) == nil {
+		obj.passwordMu.Lock()
+		obj.migrate = true
+		obj.passwordMu.Unlock()
+		return raw, nil
+	}
+	return "", &decryptError{obj.Kind(), obj.GetName()}
 }
 
 func (obj *PasswordRes) write(password string) (int, error) {
@@ -107,13 +256,183 @@ func (obj *PasswordRes) write(password string) (int, error) {
 		return -1, errwrap.Wrapf(err, "can't create file")
 	}
 	defer file.Close()
+
+	output := []byte(password + newline)
+	if obj.Encrypted && password != "" {
+		key, err := obj.resourceKey()
+		if err != nil {
+			return -1, err
+		}
+		if output, err = encryptToken(key, password); err != nil {
+			return -1, errwrap.Wrapf(err, "could not encrypt password")
+		}
+	}
+	obj.migrate = false
+
 	var c int
-	if c, err = file.Write([]byte(password + newline)); err != nil {
+	if c, err = file.Write(output); err != nil {
 		return c, errwrap.Wrapf(err, "can't write file")
 	}
 	return c, file.Sync()
 }
 
+// decryptError means the stored token failed AEAD authentication and isn't
+// valid plaintext either, so CheckApply should treat it like a failed
+// integrity check instead of an unrecoverable read error.
+type decryptError struct {
+	kind string
+	name string
+}
+
+func (e *decryptError) Error() string {
+	return fmt.Sprintf("%s[%s]: stored password failed decryption", e.kind, e.name)
+}
+
+// resourceKey derives this resource's per-token encryption key from the
+// cluster-wide master secret and this resource's name.
+func (obj *PasswordRes) resourceKey() ([]byte, error) {
+	secret, err := obj.masterSecret()
+	if err != nil {
+		return nil, err
+	}
+	h := hkdf.New(sha256.New, secret, []byte(obj.Name), []byte(hkdfInfo))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, errwrap.Wrapf(err, "could not derive password key")
+	}
+	return key, nil
+}
+
+// masterSecret fetches the cluster-wide password encryption secret from
+// etcd, atomically generating and publishing one if it doesn't exist yet.
+// The atomic create-if-absent is required here: without it, two nodes
+// racing to initialize the secret at cluster bootstrap would each publish a
+// different value, and whichever loses would find every token it already
+// encrypted unreadable against the winning secret.
+func (obj *PasswordRes) masterSecret() ([]byte, error) {
+	if obj.EmbdEtcd == nil {
+		return nil, fmt.Errorf("Encrypted requires EmbdEtcd to be set")
+	}
+	keyPath := obj.KeySource
+	if keyPath == "" {
+		keyPath = defaultMasterKeyPath
+	}
+
+	if values, err := obj.EmbdEtcd.Get(keyPath); err == nil {
+		for _, v := range values {
+			if v != "" {
+				return []byte(v), nil
+			}
+		}
+	}
+
+	secret := make([]byte, masterKeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errwrap.Wrapf(err, "could not generate cluster secret")
+	}
+
+	published, err := etcdCreateOnce(obj.EmbdEtcd, keyPath, string(secret))
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not publish cluster secret")
+	}
+	return []byte(published), nil
+}
+
+// etcdCreateOnce atomically publishes value under key if nothing is stored
+// there yet, using a Txn guarded on the key's create-revision being zero.
+// It returns whichever value ends up published: ours if we won the race, or
+// the winner's if another node beat us to it.
+func etcdCreateOnce(embdEtcd *etcd.EmbdEtcd, key, value string) (string, error) {
+	resp, err := embdEtcd.Txn(
+		[]etcdClient.Cmp{etcdClient.Compare(etcdClient.CreateRevision(key), "=", 0)},
+		[]etcdClient.Op{etcdClient.OpPut(key, value)},
+		[]etcdClient.Op{etcdClient.OpGet(key)},
+	)
+	if err != nil {
+		return "", err
+	}
+	if resp.Succeeded {
+		return value, nil
+	}
+
+	// we lost the race; adopt whatever the winner published
+	for _, r := range resp.Responses {
+		if get := r.GetResponseRange(); get != nil && len(get.Kvs) > 0 {
+			return string(get.Kvs[0].Value), nil
+		}
+	}
+	return "", fmt.Errorf("could not determine value of %s after losing the race", key)
+}
+
+// coordinateShared returns the cluster's single value for this shared
+// password. If rotate is false, it adopts whatever's already published,
+// generating and atomically publishing a new one only if nobody has yet. If
+// rotate is true, it always generates and publishes a new value, which is
+// how Refresh() forces every node managing this resource to pick up a fresh
+// password.
+func (obj *PasswordRes) coordinateShared(rotate bool) (string, error) {
+	key := obj.sharedKey()
+
+	if !rotate {
+		if values, err := obj.EmbdEtcd.Get(key); err == nil {
+			for _, v := range values {
+				if v != "" {
+					return v, nil
+				}
+			}
+		}
+	}
+
+	password, err := obj.generate()
+	if err != nil {
+		return "", errwrap.Wrapf(err, "could not generate shared password")
+	}
+
+	if rotate {
+		// an explicit refresh always wins; every node's watcher picks up
+		// this new revision and reconverges.
+		obj.EmbdEtcd.Set(key, password)
+		return password, nil
+	}
+
+	// nobody had published a value: try to be the one who does, atomically.
+	published, err := etcdCreateOnce(obj.EmbdEtcd, key, password)
+	if err != nil {
+		return "", errwrap.Wrapf(err, "could not publish shared password")
+	}
+	return published, nil
+}
+
+// encryptToken seals password under key, returning nonce||ciphertext||tag.
+func encryptToken(key []byte, password string) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, []byte(password), nil), nil
+}
+
+// decryptToken opens a nonce||ciphertext||tag blob produced by encryptToken.
+func decryptToken(key, data []byte) (string, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("encrypted token is too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
 // generate generates a new password.
 func (obj *PasswordRes) generate() (string, error) {
 	max := len(alphabet) - 1 // last index
@@ -192,6 +511,9 @@ func (obj *PasswordRes) Watch(processChan chan event.Event) error {
 		return err
 	}
 	defer obj.recWatcher.Close()
+	if obj.sharedCancel != nil {
+		defer obj.sharedCancel()
+	}
 
 	var send = false // send event?
 	var exit = false
@@ -210,6 +532,11 @@ func (obj *PasswordRes) Watch(processChan chan event.Event) error {
 			send = true
 			obj.StateOK(false) // dirty
 
+		case <-obj.sharedChan: // another node rotated our shared password
+			cuid.SetConverged(false)
+			send = true
+			obj.StateOK(false) // dirty
+
 		case event := <-obj.Events():
 			cuid.SetConverged(false)
 			// we avoid sending events on unpause
@@ -247,10 +574,13 @@ func (obj *PasswordRes) CheckApply(apply bool) (checkOK bool, err error) {
 
 	password, err := obj.read() // password might be empty if just a token
 	if err != nil {
-		if !os.IsNotExist(err) {
+		if _, ok := err.(*decryptError); ok {
+			exists = true // the file is there, but it didn't decrypt
+		} else if os.IsNotExist(err) {
+			exists = false
+		} else {
 			return false, errwrap.Wrapf(err, "unknown read error")
 		}
-		exists = false
 	}
 
 	if exists {
@@ -266,13 +596,20 @@ func (obj *PasswordRes) CheckApply(apply bool) (checkOK bool, err error) {
 		write = true
 	}
 
+	obj.passwordMu.Lock()
+	migrate := obj.migrate
+	obj.passwordMu.Unlock()
+	if migrate { // plaintext token found, re-encrypt it in place
+		write = true
+	}
+
 	// if we previously had !obj.Saved, and now we want it, we re-generate!
 	if refresh || !exists || (obj.Saved && password == "") {
 		generate = true
 	}
 
 	// stored password isn't consistent with memory
-	if p := obj.Password; obj.Saved && (p != nil && *p != password) {
+	if p := obj.getPassword(); obj.Saved && (p != nil && *p != password) {
 		write = true
 	}
 
@@ -293,24 +630,32 @@ func (obj *PasswordRes) CheckApply(apply bool) (checkOK bool, err error) {
 		// generate the actual password
 		var err error
 		log.Printf("%s[%s]: Generating new password...", obj.Kind(), obj.GetName())
-		if password, err = obj.generate(); err != nil { // generate one!
+		if obj.Shared {
+			// refresh means we're the node rotating it; everyone else
+			// adopts whatever we (or the first node to race us) publish
+			password, err = obj.coordinateShared(refresh)
+		} else {
+			password, err = obj.generate()
+		}
+		if err != nil {
 			return false, errwrap.Wrapf(err, "could not generate password")
 		}
 	}
 
-	obj.Password = &password // save in memory
+	if err := obj.setPassword(password, false); err != nil { // save in memory
+		return false, errwrap.Wrapf(err, "could not save password in memory")
+	}
 
 	var output string // the string to write out
 
 	// if memory value != value on disk, save it
 	if write {
-		if obj.Saved { // save password as clear text
-			// TODO: would it make sense to encrypt this password?
+		if obj.Saved { // save the password; write() encrypts it if asked to
 			output = password
 		}
 		// write either an empty token, or the password
 		log.Printf("%s[%s]: Writing password token...", obj.Kind(), obj.GetName())
-		if _, err := obj.write(output); err != nil {
+		if _, err := obj.writeToken(output); err != nil {
 			return false, errwrap.Wrapf(err, "can't write to file")
 		}
 	}
@@ -374,6 +719,15 @@ func (obj *PasswordRes) Compare(res Res) bool {
 		if obj.CheckRecovery != res.CheckRecovery {
 			return false
 		}
+		if obj.Encrypted != res.Encrypted {
+			return false
+		}
+		if obj.KeySource != res.KeySource {
+			return false
+		}
+		if obj.Shared != res.Shared {
+			return false
+		}
 	default:
 		return false
 	}
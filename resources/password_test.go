@@ -0,0 +1,69 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"testing"
+)
+
+func TestEncryptDecryptTokenRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	sealed, err := encryptToken(key, "hunter2")
+	if err != nil {
+		t.Fatalf("encryptToken failed: %s", err.Error())
+	}
+
+	plain, err := decryptToken(key, sealed)
+	if err != nil {
+		t.Fatalf("decryptToken failed: %s", err.Error())
+	}
+	if plain != "hunter2" {
+		t.Fatalf("got password %q, expected %q", plain, "hunter2")
+	}
+}
+
+func TestDecryptTokenDetectsTampering(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	sealed, err := encryptToken(key, "hunter2")
+	if err != nil {
+		t.Fatalf("encryptToken failed: %s", err.Error())
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 0xff // flip a bit in the auth tag
+
+	if _, err := decryptToken(key, tampered); err == nil {
+		t.Fatal("decryptToken accepted a tampered ciphertext")
+	}
+
+	wrongKey := make([]byte, 32)
+	for i := range wrongKey {
+		wrongKey[i] = byte(i + 1)
+	}
+	if _, err := decryptToken(wrongKey, sealed); err == nil {
+		t.Fatal("decryptToken accepted a token sealed with a different key")
+	}
+}
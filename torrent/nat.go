@@ -0,0 +1,202 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package torrent
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/huin/goupnp/dcps/internetgateway1"
+	"github.com/jackpal/gateway"
+	natpmp "github.com/jackpal/go-nat-pmp"
+)
+
+// NATMode selects how Service discovers its external IP and forwards its
+// listen port through the local gateway.
+type NATMode string
+
+const (
+	// NATOff disables NAT traversal; Service resolves Hostname directly,
+	// as it always has.
+	NATOff NATMode = "off"
+	// NATUPnP forwards the listen port via UPnP IGD only.
+	NATUPnP NATMode = "upnp"
+	// NATPMP forwards the listen port via NAT-PMP only.
+	NATPMP NATMode = "natpmp"
+	// NATAuto tries UPnP first and falls back to NAT-PMP.
+	NATAuto NATMode = "auto"
+)
+
+// natLeaseDuration is how long a port mapping is requested for. Refreshes
+// are scheduled well before it runs out.
+const natLeaseDuration = 1 * time.Hour
+
+// natRefreshInterval is how often we re-request the mapping and re-check the
+// external IP, comfortably inside natLeaseDuration.
+const natRefreshInterval = 45 * time.Minute
+
+// natTraversal owns the port mapping and external IP discovery for a
+// Service. Exactly one of upnpClient or pmpClient is set, depending on which
+// protocol succeeded.
+type natTraversal struct {
+	port int
+
+	upnpClient *internetgateway1.WANIPConnection1
+	pmpClient  *natpmp.Client
+
+	externalIP net.IP
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// discoverNAT probes the local gateway according to mode, requests a
+// mapping for port on both TCP and UDP, and returns the discovered external
+// IP.
+func discoverNAT(mode NATMode, port int) (*natTraversal, error) {
+	nt := &natTraversal{port: port, stopChan: make(chan struct{})}
+
+	if mode == NATUPnP || mode == NATAuto {
+		if clients, _, err := internetgateway1.NewWANIPConnection1Clients(); err == nil && len(clients) > 0 {
+			nt.upnpClient = clients[0]
+			if ip, err := nt.mapUPnP(); err == nil {
+				nt.externalIP = ip
+				return nt, nil
+			}
+			nt.upnpClient = nil
+		}
+		if mode == NATUPnP {
+			return nil, fmt.Errorf("torrent: no UPnP IGD gateway found")
+		}
+	}
+
+	if mode == NATPMP || mode == NATAuto {
+		gatewayIP, err := gateway.DiscoverGateway()
+		if err != nil {
+			return nil, fmt.Errorf("torrent: could not discover gateway for NAT-PMP: %s", err.Error())
+		}
+		nt.pmpClient = natpmp.NewClient(gatewayIP)
+		ip, err := nt.mapNATPMP()
+		if err != nil {
+			return nil, fmt.Errorf("torrent: NAT-PMP mapping failed: %s", err.Error())
+		}
+		nt.externalIP = ip
+		return nt, nil
+	}
+
+	return nil, fmt.Errorf("torrent: NAT traversal could not find a usable gateway")
+}
+
+func (nt *natTraversal) mapUPnP() (net.IP, error) {
+	lease := uint32(natLeaseDuration / time.Second)
+	if err := nt.upnpClient.AddPortMapping("", uint16(nt.port), "TCP", uint16(nt.port), "", true, "mgmt", lease); err != nil {
+		return nil, err
+	}
+	if err := nt.upnpClient.AddPortMapping("", uint16(nt.port), "UDP", uint16(nt.port), "", true, "mgmt", lease); err != nil {
+		return nil, err
+	}
+	ipStr, err := nt.upnpClient.GetExternalIPAddress()
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("torrent: gateway returned invalid external IP %q", ipStr)
+	}
+	return ip, nil
+}
+
+func (nt *natTraversal) mapNATPMP() (net.IP, error) {
+	lease := int(natLeaseDuration / time.Second)
+	if _, err := nt.pmpClient.AddPortMapping("tcp", nt.port, nt.port, lease); err != nil {
+		return nil, err
+	}
+	if _, err := nt.pmpClient.AddPortMapping("udp", nt.port, nt.port, lease); err != nil {
+		return nil, err
+	}
+	res, err := nt.pmpClient.GetExternalAddress()
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(res.ExternalIPAddress[:]), nil
+}
+
+// remap re-requests whichever mapping protocol previously succeeded.
+func (nt *natTraversal) remap() (net.IP, error) {
+	if nt.upnpClient != nil {
+		return nt.mapUPnP()
+	}
+	return nt.mapNATPMP()
+}
+
+// run refreshes the port mapping before its lease expires, and republishes
+// svc's DHT node record under /dht/nodes/<hostname> whenever the external IP
+// changes.
+func (nt *natTraversal) run(svc *Service) {
+	nt.wg.Add(1)
+	go func() {
+		defer nt.wg.Done()
+		ticker := time.NewTicker(natRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ip, err := nt.remap()
+				if err != nil {
+					log.Printf("torrent: NAT mapping refresh failed: %s", err.Error())
+					continue
+				}
+				if !ip.Equal(nt.externalIP) {
+					nt.externalIP = ip
+					log.Printf("torrent: external IP changed to %s, republishing DHT node", ip.String())
+					svc.embdEtcd.Set(svc.nodePath, fmt.Sprintf("%s:%d", ip.String(), nt.port))
+				}
+			case <-nt.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// teardown removes the port mapping this natTraversal created.
+func (nt *natTraversal) teardown() {
+	close(nt.stopChan)
+	nt.wg.Wait()
+
+	if nt.upnpClient != nil {
+		if err := nt.upnpClient.DeletePortMapping("", uint16(nt.port), "TCP"); err != nil {
+			log.Printf("torrent: failed to remove UPnP TCP mapping: %s", err.Error())
+		}
+		if err := nt.upnpClient.DeletePortMapping("", uint16(nt.port), "UDP"); err != nil {
+			log.Printf("torrent: failed to remove UPnP UDP mapping: %s", err.Error())
+		}
+		return
+	}
+	if nt.pmpClient != nil {
+		// a zero lifetime tells the gateway to delete the mapping
+		if _, err := nt.pmpClient.AddPortMapping("tcp", nt.port, nt.port, 0); err != nil {
+			log.Printf("torrent: failed to remove NAT-PMP TCP mapping: %s", err.Error())
+		}
+		if _, err := nt.pmpClient.AddPortMapping("udp", nt.port, nt.port, 0); err != nil {
+			log.Printf("torrent: failed to remove NAT-PMP UDP mapping: %s", err.Error())
+		}
+	}
+}
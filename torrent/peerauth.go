@@ -0,0 +1,349 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package torrent
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path"
+	"sync"
+
+	"github.com/purpleidea/mgmt/etcd"
+
+	etcdClient "github.com/coreos/etcd/clientv3"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// hkdfInfo is the context string mixed into every derived session key, so a
+// shared secret from this handshake can never be confused with a key derived
+// elsewhere in mgmt.
+const hkdfInfo = "mgmt-torrent-peer-v1"
+
+// peerAuth restricts torrent peer connections to other mgmt nodes in the
+// same cluster. Each Service generates a long-lived Ed25519 identity,
+// publishes its public key under /dht/keys/<hostname> in etcd, and only
+// completes a connection handshake with peers whose signing key appears in
+// that allowlist.
+type peerAuth struct {
+	signPub  ed25519.PublicKey
+	signPriv ed25519.PrivateKey
+
+	mu        sync.RWMutex
+	allowlist map[string]ed25519.PublicKey // hostname -> signing key
+
+	keysCancel func()
+}
+
+// newPeerAuth generates this node's identity, publishes it under
+// /dht/keys/<hostname>, and starts watching that prefix to maintain the
+// allowlist of cluster peers.
+func newPeerAuth(embdEtcd *etcd.EmbdEtcd, hostname string) (*peerAuth, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("torrent: could not generate peer identity: %s", err.Error())
+	}
+
+	pa := &peerAuth{
+		signPub:   pub,
+		signPriv:  priv,
+		allowlist: make(map[string]ed25519.PublicKey),
+	}
+
+	pa.keysCancel, err = embdEtcd.AddWatcher("/dht/keys/", pa.keysChangeCallback, false, true, etcdClient.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("torrent: could not watch /dht/keys/: %s", err.Error())
+	}
+
+	// Only interested on success here
+	if values, err := embdEtcd.Get("/dht/keys/"); err == nil {
+		for key, value := range values {
+			pa.addKey(key, value)
+		}
+	}
+
+	embdEtcd.Set(fmt.Sprintf("/dht/keys/%s", hostname), string(pub))
+
+	return pa, nil
+}
+
+func (pa *peerAuth) keysChangeCallback(re *etcd.RE) error {
+	if re.Error() != nil {
+		return nil
+	}
+
+	for _, event := range re.Response().Events {
+		switch event.Type {
+		case etcdClient.EventTypePut:
+			pa.addKey(string(event.Kv.Key), string(event.Kv.Value))
+		case etcdClient.EventTypeDelete:
+			pa.removeKey(string(event.Kv.Key))
+		}
+	}
+
+	return nil
+}
+
+func (pa *peerAuth) addKey(key, value string) {
+	if len(value) != ed25519.PublicKeySize {
+		log.Printf("torrent: ignoring invalid peer key published at %s", key)
+		return
+	}
+	pub := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	copy(pub, value)
+
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	pa.allowlist[path.Base(key)] = pub
+}
+
+func (pa *peerAuth) removeKey(key string) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	delete(pa.allowlist, path.Base(key))
+}
+
+// isAllowed reports whether pub belongs to a known cluster peer.
+func (pa *peerAuth) isAllowed(pub ed25519.PublicKey) bool {
+	pa.mu.RLock()
+	defer pa.mu.RUnlock()
+	for _, p := range pa.allowlist {
+		if p.Equal(pub) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxFrameSize bounds the sealed frame length secureConn.Read will trust
+// from the 4-byte length header, before the AEAD tag is even checked, so a
+// peer that completed the handshake (or a corrupted/buggy one) can't force
+// a multi-gigabyte allocation with a single crafted header.
+const maxFrameSize = 16 * 1024 * 1024
+
+// handshakeSize is the length in bytes of a single wire handshake message:
+// a long-lived signing key, an ephemeral X25519 public key, and a signature
+// over it.
+const handshakeSize = ed25519.PublicKeySize + 32 + ed25519.SignatureSize
+
+// handshake performs a mutually-authenticated station-to-station exchange
+// over conn: both sides generate an ephemeral X25519 keypair, sign it with
+// their long-lived Ed25519 key, and verify the peer's signature against the
+// cluster allowlist before deriving a ChaCha20-Poly1305 session from the
+// shared secret. initiator distinguishes which side of the derived key
+// schedule each end uses to send vs. receive.
+func (pa *peerAuth) handshake(conn net.Conn, initiator bool) (net.Conn, error) {
+	var ephPub, ephPriv [32]byte
+	if _, err := io.ReadFull(rand.Reader, ephPriv[:]); err != nil {
+		return nil, fmt.Errorf("torrent: could not generate ephemeral key: %s", err.Error())
+	}
+	curve25519.ScalarBaseMult(&ephPub, &ephPriv)
+	sig := ed25519.Sign(pa.signPriv, ephPub[:])
+
+	local := make([]byte, 0, handshakeSize)
+	local = append(local, pa.signPub...)
+	local = append(local, ephPub[:]...)
+	local = append(local, sig...)
+
+	if _, err := conn.Write(local); err != nil {
+		return nil, fmt.Errorf("torrent: could not send handshake: %s", err.Error())
+	}
+
+	remote := make([]byte, handshakeSize)
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return nil, fmt.Errorf("torrent: could not read peer handshake: %s", err.Error())
+	}
+	remotePub := ed25519.PublicKey(remote[:ed25519.PublicKeySize])
+	remoteEphPub := remote[ed25519.PublicKeySize : ed25519.PublicKeySize+32]
+	remoteSig := remote[ed25519.PublicKeySize+32:]
+
+	if !pa.isAllowed(remotePub) {
+		return nil, fmt.Errorf("torrent: peer %x is not a cluster member", remotePub)
+	}
+	if !ed25519.Verify(remotePub, remoteEphPub, remoteSig) {
+		return nil, fmt.Errorf("torrent: peer handshake signature is invalid")
+	}
+
+	var shared [32]byte
+	curve25519.ScalarMult(&shared, &ephPriv, (*[32]byte)(remoteEphPub))
+
+	sendKey, recvKey, err := sessionKeys(shared[:], initiator)
+	if err != nil {
+		return nil, err
+	}
+	sendAEAD, err := chacha20poly1305.New(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recvAEAD, err := chacha20poly1305.New(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &secureConn{Conn: conn, sendAEAD: sendAEAD, recvAEAD: recvAEAD}, nil
+}
+
+// sessionKeys derives the two directional session keys from the STS shared
+// secret, returning (send, recv) from initiator's point of view.
+func sessionKeys(shared []byte, initiator bool) (send, recv []byte, err error) {
+	h := hkdf.New(sha256.New, shared, nil, []byte(hkdfInfo))
+	initToResp := make([]byte, chacha20poly1305.KeySize)
+	respToInit := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, initToResp); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(h, respToInit); err != nil {
+		return nil, nil, err
+	}
+	if initiator {
+		return initToResp, respToInit, nil
+	}
+	return respToInit, initToResp, nil
+}
+
+// secureConn is a net.Conn that transparently encrypts and authenticates
+// every Write/Read with the session keys negotiated by handshake. Each
+// message is framed as a 4-byte big-endian length followed by the sealed
+// ChaCha20-Poly1305 frame.
+type secureConn struct {
+	net.Conn
+	sendAEAD cipher.AEAD
+	recvAEAD cipher.AEAD
+	sendSeq  uint64
+	recvSeq  uint64
+	readBuf  []byte
+
+	// writeMu and readMu serialize Write and Read respectively:
+	// secureConn is handed to anacrolix/torrent as a plain net.Conn, whose
+	// contract allows concurrent callers, but two concurrent Writes
+	// racing on sendSeq could seal two different frames under the same
+	// key+nonce -- a catastrophic break of ChaCha20-Poly1305, not just a
+	// benign data race.
+	writeMu sync.Mutex
+	readMu  sync.Mutex
+}
+
+func (c *secureConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	nonce := make([]byte, c.sendAEAD.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], c.sendSeq)
+	c.sendSeq++
+
+	sealed := c.sendAEAD.Seal(nil, nonce, p, nil)
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(sealed)))
+	if _, err := c.Conn.Write(header); err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(sealed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.readBuf) == 0 {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		frameLen := binary.BigEndian.Uint32(header)
+		if frameLen > maxFrameSize {
+			return 0, fmt.Errorf("torrent: peer frame of %d bytes exceeds the %d byte limit", frameLen, maxFrameSize)
+		}
+		sealed := make([]byte, frameLen)
+		if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+			return 0, err
+		}
+
+		nonce := make([]byte, c.recvAEAD.NonceSize())
+		binary.BigEndian.PutUint64(nonce[len(nonce)-8:], c.recvSeq)
+		c.recvSeq++
+
+		plain, err := c.recvAEAD.Open(nil, nonce, sealed, nil)
+		if err != nil {
+			return 0, fmt.Errorf("torrent: peer frame failed authentication: %s", err.Error())
+		}
+		c.readBuf = plain
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// secureListener wraps a net.Listener so every Accept()ed connection is put
+// through the authenticated handshake before it's handed to the caller.
+// Peers that fail the handshake are logged and dropped; Accept keeps listening
+// rather than returning the error, since one bad peer shouldn't bring down
+// the torrent client's listen loop.
+type secureListener struct {
+	net.Listener
+	pa *peerAuth
+}
+
+func (l *secureListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		secure, err := l.pa.handshake(conn, false)
+		if err != nil {
+			log.Printf("torrent: rejecting peer %s: %s", conn.RemoteAddr(), err.Error())
+			conn.Close()
+			continue
+		}
+		return secure, nil
+	}
+}
+
+// secureDialer wraps a net.Dialer so every outgoing peer connection performs
+// the authenticated handshake before the torrent client starts exchanging
+// pieces over it.
+type secureDialer struct {
+	net.Dialer
+	pa *peerAuth
+}
+
+func (d *secureDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	secure, err := d.pa.handshake(conn, true)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return secure, nil
+}
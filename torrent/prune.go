@@ -0,0 +1,189 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package torrent
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// PrunePolicy controls which completed torrents Service's prune subsystem
+// evicts. A zero-valued field disables that part of the policy.
+type PrunePolicy struct {
+	// MaxTotalBytes is the maximum combined size on disk across every
+	// torrent this Service is seeding.
+	MaxTotalBytes int64
+	// MaxAge is how long a torrent may stick around after it finishes
+	// downloading before it becomes eligible for eviction.
+	MaxAge time.Duration
+	// MinSeedRatio is the upload/download ratio a completed torrent must
+	// reach before it's eligible for eviction.
+	MinSeedRatio float64
+}
+
+// EvictionEvent records a single eviction decision made by the prune
+// subsystem: which torrent was dropped, and which policy predicate (or
+// "manual"/"tombstone") triggered it.
+type EvictionEvent struct {
+	Name   string
+	Reason string
+}
+
+// startPrune arms a re-armed timer that evaluates policy against
+// svc.client.Torrents() every interval, evicting anything that violates it.
+func (svc *Service) startPrune(interval time.Duration, policy PrunePolicy) {
+	svc.pruneStop = make(chan struct{})
+	timer := time.NewTimer(interval)
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				select {
+				case svc.actionChan <- func() { svc.pruneTick(policy) }:
+				case <-svc.closing:
+					timer.Stop()
+					return
+				}
+				timer.Reset(interval)
+			case <-svc.pruneStop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// pruneTick runs on the Service mainloop: it records when torrents finish,
+// and evicts anything that violates policy. It must only be called from an
+// action on actionChan, since it reads svc.client.
+func (svc *Service) pruneTick(policy PrunePolicy) {
+	now := time.Now()
+
+	type candidate struct {
+		name  string
+		bytes int64
+	}
+	var candidates []candidate
+	var total int64
+
+	for _, t := range svc.client.Torrents() {
+		info := t.Info()
+		if info == nil {
+			continue // still fetching metadata, nothing to prune yet
+		}
+		name := t.Name()
+		size := info.TotalLength()
+		total += size
+
+		if t.BytesCompleted() == size {
+			if _, ok := svc.completedAt[name]; !ok {
+				svc.completedAt[name] = now
+			}
+		}
+		candidates = append(candidates, candidate{name: name, bytes: size})
+	}
+
+	for _, c := range candidates {
+		reason, evict := svc.shouldEvict(c.name, c.bytes, total, policy, now)
+		if !evict {
+			continue
+		}
+		svc.doEvict(c.name, reason)
+		total -= c.bytes
+	}
+}
+
+// shouldEvict decides whether name should be pruned, given bytes is its
+// size, total is the combined size of every torrent being considered this
+// tick, and now is the time this tick started.
+func (svc *Service) shouldEvict(name string, bytes, total int64, policy PrunePolicy, now time.Time) (string, bool) {
+	if svc.tombstoned[name] {
+		// some node wants this torrent gone everywhere, regardless of
+		// whether it's finished downloading here.
+		return "tombstone", true
+	}
+
+	completedAt, done := svc.completedAt[name]
+	if !done {
+		return "", false // never evict something still downloading
+	}
+
+	if policy.MaxAge > 0 && now.Sub(completedAt) >= policy.MaxAge {
+		return "max-age", true
+	}
+	if policy.MaxTotalBytes > 0 && total > policy.MaxTotalBytes {
+		return "quota", true
+	}
+	if policy.MinSeedRatio > 0 && bytes > 0 {
+		if ratio := seedRatio(svc, name, bytes); ratio >= policy.MinSeedRatio {
+			return "seed-ratio", true
+		}
+	}
+	return "", false
+}
+
+// seedRatio returns the upload/download ratio for name, given its size in
+// bytes, or 0 if the torrent can no longer be found.
+func seedRatio(svc *Service, name string, bytes int64) float64 {
+	for _, t := range svc.client.Torrents() {
+		if t.Name() != name {
+			continue
+		}
+		return float64(t.Stats().BytesWrittenData.Int64()) / float64(bytes)
+	}
+	return 0
+}
+
+// doEvict stops seeding name, deletes its etcd record, and removes its
+// on-disk data via the storage backend. It must only be called from an
+// action on actionChan, since it touches svc.client.
+func (svc *Service) doEvict(name, reason string) {
+	for _, t := range svc.client.Torrents() {
+		if t.Name() == name {
+			t.Drop()
+			break
+		}
+	}
+	delete(svc.completedAt, name)
+	delete(svc.tombstoned, name)
+
+	if _, err := svc.embdEtcd.Delete(fmt.Sprintf("/dht/torrents/%s", name)); err != nil {
+		log.Printf("torrent: Failed to delete etcd record for '%s': %s", name, err.Error())
+	}
+	if err := svc.storage.RemoveTorrent(name); err != nil {
+		log.Printf("torrent: Failed to remove on-disk data for '%s': %s", name, err.Error())
+	}
+
+	log.Printf("torrent: Evicted '%s': %s", name, reason)
+
+	select {
+	case svc.Evictions <- EvictionEvent{Name: name, Reason: reason}:
+	default: // nobody's listening; don't block the mainloop
+	}
+}
+
+// Evict immediately removes name: it stops seeding, deletes the etcd
+// record, and removes its on-disk data via the storage backend.
+func (svc *Service) Evict(name string) {
+	select {
+	case svc.actionChan <- func() { svc.doEvict(name, "manual") }:
+	case <-svc.closing:
+	}
+}
@@ -0,0 +1,98 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package torrent
+
+import (
+	"testing"
+	"time"
+)
+
+// newPruneTestService returns a Service with just enough state for
+// shouldEvict, which doesn't otherwise need a live torrent client or etcd
+// connection for the branches exercised below.
+func newPruneTestService() *Service {
+	return &Service{
+		completedAt: make(map[string]time.Time),
+		tombstoned:  make(map[string]bool),
+	}
+}
+
+func TestShouldEvictStillDownloading(t *testing.T) {
+	svc := newPruneTestService()
+	policy := PrunePolicy{MaxAge: time.Second}
+
+	if _, evict := svc.shouldEvict("foo", 100, 100, policy, time.Now()); evict {
+		t.Fatal("a torrent with no completedAt entry must never be evicted")
+	}
+}
+
+func TestShouldEvictTombstone(t *testing.T) {
+	svc := newPruneTestService()
+	svc.tombstoned["foo"] = true
+
+	// a tombstone evicts even though the torrent has no PrunePolicy set and
+	// hasn't finished downloading.
+	reason, evict := svc.shouldEvict("foo", 100, 100, PrunePolicy{}, time.Now())
+	if !evict || reason != "tombstone" {
+		t.Fatalf("got (%q, %v), expected (\"tombstone\", true)", reason, evict)
+	}
+}
+
+func TestShouldEvictMaxAge(t *testing.T) {
+	svc := newPruneTestService()
+	now := time.Now()
+	svc.completedAt["foo"] = now.Add(-2 * time.Hour)
+
+	policy := PrunePolicy{MaxAge: time.Hour}
+	reason, evict := svc.shouldEvict("foo", 100, 100, policy, now)
+	if !evict || reason != "max-age" {
+		t.Fatalf("got (%q, %v), expected (\"max-age\", true)", reason, evict)
+	}
+
+	// below the age threshold, it survives.
+	svc.completedAt["bar"] = now.Add(-30 * time.Minute)
+	if _, evict := svc.shouldEvict("bar", 100, 100, policy, now); evict {
+		t.Fatal("a torrent younger than MaxAge must not be evicted")
+	}
+}
+
+func TestShouldEvictQuota(t *testing.T) {
+	svc := newPruneTestService()
+	now := time.Now()
+	svc.completedAt["foo"] = now
+
+	policy := PrunePolicy{MaxTotalBytes: 1000}
+	reason, evict := svc.shouldEvict("foo", 100, 1500, policy, now)
+	if !evict || reason != "quota" {
+		t.Fatalf("got (%q, %v), expected (\"quota\", true)", reason, evict)
+	}
+
+	if _, evict := svc.shouldEvict("foo", 100, 500, policy, now); evict {
+		t.Fatal("total under MaxTotalBytes must not be evicted")
+	}
+}
+
+func TestShouldEvictNoPolicyTriggered(t *testing.T) {
+	svc := newPruneTestService()
+	now := time.Now()
+	svc.completedAt["foo"] = now
+
+	if _, evict := svc.shouldEvict("foo", 100, 100, PrunePolicy{}, now); evict {
+		t.Fatal("a completed torrent with no policy set must not be evicted")
+	}
+}
@@ -0,0 +1,182 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package torrent
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// StorageBackend is the abstraction Service uses to persist torrent piece
+// data. It plays the same role as anacrolix/torrent's TorrentDataOpener, but
+// lets mgmt swap in something other than a plain directory on Prefix, so
+// payload data can live in memory or on a separate volume without moving the
+// metainfo cache.
+type StorageBackend interface {
+	// OpenTorrent returns the per-torrent data store for info, creating it
+	// if it doesn't already exist.
+	OpenTorrent(info *metainfo.Info) (TorrentData, error)
+
+	// RemoveTorrent deletes the data store for the torrent named name. It
+	// is a no-op if no such store exists.
+	RemoveTorrent(name string) error
+}
+
+// TorrentData is a per-torrent piece data store, handed back by a
+// StorageBackend. It matches anacrolix/torrent's own Data interface so it can
+// be plugged directly into Config.TorrentDataOpener.
+type TorrentData interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// FileStorage is the original filesystem-backed StorageBackend. Each torrent
+// gets its own subdirectory of Dir, named after the torrent.
+type FileStorage struct {
+	Dir string
+}
+
+// NewFileStorage creates a FileStorage rooted at dir, creating dir if it
+// doesn't already exist.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &FileStorage{Dir: dir}, nil
+}
+
+// OpenTorrent implements the StorageBackend interface.
+func (s *FileStorage) OpenTorrent(info *metainfo.Info) (TorrentData, error) {
+	dir := filepath.Join(s.Dir, info.Name)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &fileTorrentData{path: filepath.Join(dir, "data")}, nil
+}
+
+// fileTorrentData stores a torrent's pieces in a single flat file, opening a
+// fresh handle per call since mgmt's torrents are usually small and
+// short-lived.
+type fileTorrentData struct {
+	path string
+}
+
+func (d *fileTorrentData) ReadAt(p []byte, off int64) (int, error) {
+	f, err := os.Open(d.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(p, off)
+}
+
+func (d *fileTorrentData) WriteAt(p []byte, off int64) (int, error) {
+	f, err := os.OpenFile(d.path, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.WriteAt(p, off)
+}
+
+func (d *fileTorrentData) Close() error { return nil }
+
+// RemoveTorrent implements the StorageBackend interface.
+func (s *FileStorage) RemoveTorrent(name string) error {
+	err := os.RemoveAll(filepath.Join(s.Dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// MemoryStorage is a StorageBackend that keeps torrent payloads entirely in
+// RAM. It never touches disk, so it's suitable for ephemeral or small
+// payloads that mgmt nodes pass around over the DHT and that don't need to
+// survive a restart, and it lets the rest of mgmt run on a read-only root
+// filesystem.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	files map[string]*memTorrentData
+}
+
+// NewMemoryStorage creates an empty in-memory StorageBackend.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		files: make(map[string]*memTorrentData),
+	}
+}
+
+// OpenTorrent implements the StorageBackend interface.
+func (s *MemoryStorage) OpenTorrent(info *metainfo.Info) (TorrentData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.files[info.Name]
+	if !ok {
+		d = &memTorrentData{}
+		s.files[info.Name] = d
+	}
+	return d, nil
+}
+
+// memTorrentData is a growable in-memory buffer addressed like a file.
+type memTorrentData struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (d *memTorrentData) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if off >= int64(len(d.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *memTorrentData) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	end := off + int64(len(p))
+	if end > int64(len(d.buf)) {
+		grown := make([]byte, end)
+		copy(grown, d.buf)
+		d.buf = grown
+	}
+	copy(d.buf[off:], p)
+	return len(p), nil
+}
+
+func (d *memTorrentData) Close() error { return nil }
+
+// RemoveTorrent implements the StorageBackend interface.
+func (s *MemoryStorage) RemoveTorrent(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+	return nil
+}
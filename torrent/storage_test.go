@@ -0,0 +1,90 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package torrent
+
+import (
+	"io"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func testStorageReadWriteAt(t *testing.T, s StorageBackend) {
+	data, err := s.OpenTorrent(&metainfo.Info{Name: "foo"})
+	if err != nil {
+		t.Fatalf("OpenTorrent failed: %s", err.Error())
+	}
+	defer data.Close()
+
+	if _, err := data.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %s", err.Error())
+	}
+	if _, err := data.WriteAt([]byte("world"), 5); err != nil {
+		t.Fatalf("WriteAt failed: %s", err.Error())
+	}
+
+	buf := make([]byte, 10)
+	if _, err := data.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt failed: %s", err.Error())
+	}
+	if string(buf) != "helloworld" {
+		t.Fatalf("got %q, expected %q", buf, "helloworld")
+	}
+
+	// re-opening the same name must return the same underlying store.
+	again, err := s.OpenTorrent(&metainfo.Info{Name: "foo"})
+	if err != nil {
+		t.Fatalf("re-OpenTorrent failed: %s", err.Error())
+	}
+	defer again.Close()
+	if _, err := again.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt on reopened store failed: %s", err.Error())
+	}
+	if string(buf) != "helloworld" {
+		t.Fatalf("reopened store got %q, expected %q", buf, "helloworld")
+	}
+
+	// reading past the end returns io.EOF along with whatever was there.
+	short := make([]byte, 4)
+	n, err := data.ReadAt(short, 8)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF reading past the end, got %v", err)
+	}
+	if string(short[:n]) != "ld" {
+		t.Fatalf("got %q, expected %q", short[:n], "ld")
+	}
+
+	if err := s.RemoveTorrent("foo"); err != nil {
+		t.Fatalf("RemoveTorrent failed: %s", err.Error())
+	}
+	if err := s.RemoveTorrent("does-not-exist"); err != nil {
+		t.Fatalf("RemoveTorrent on a missing torrent should be a no-op, got: %s", err.Error())
+	}
+}
+
+func TestFileStorageReadWriteAt(t *testing.T) {
+	s, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStorage failed: %s", err.Error())
+	}
+	testStorageReadWriteAt(t, s)
+}
+
+func TestMemoryStorageReadWriteAt(t *testing.T) {
+	testStorageReadWriteAt(t, NewMemoryStorage())
+}
@@ -24,6 +24,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 
 	"github.com/purpleidea/mgmt/etcd"
 
@@ -34,16 +35,70 @@ import (
 	multierr "github.com/hashicorp/go-multierror"
 )
 
+// Config holds the parameters needed to start a torrent Service.
+type Config struct {
+	EmbdEtcd *etcd.EmbdEtcd
+	Prefix   string
+	Hostname string
+	Debug    bool
+
+	// DefaultStorage is the StorageBackend used to store torrent payload
+	// data. If nil, a FileStorage rooted at Prefix/torrent/storage is used.
+	DefaultStorage StorageBackend
+
+	// NoMetainfoCache disables the on-disk metainfo/resume cache that
+	// anacrolix/torrent otherwise keeps under Prefix, so mgmt can run on a
+	// read-only root filesystem when DefaultStorage doesn't touch disk
+	// either.
+	NoMetainfoCache bool
+
+	// NATTraversal selects how the external IP is discovered and the
+	// listen port forwarded: NATOff, NATUPnP, NATPMP, or NATAuto. Defaults
+	// to NATOff, which resolves Hostname directly like before.
+	NATTraversal NATMode
+	// ListenPort is the fixed TCP/UDP port the torrent client listens on.
+	// It's required (non-zero) for NATTraversal to map a port through the
+	// gateway, and for EncryptedPeers to bind its own listener.
+	ListenPort int
+
+	// EncryptedPeers restricts peer connections to other mgmt nodes in the
+	// cluster: each Service publishes an Ed25519 identity to etcd and
+	// rejects any peer that can't complete an authenticated handshake
+	// against that allowlist.
+	EncryptedPeers bool
+
+	// PruneInterval is how often the prune subsystem re-evaluates
+	// PrunePolicy against the torrents this Service is seeding. Zero
+	// disables pruning.
+	PruneInterval time.Duration
+	// PrunePolicy controls which completed torrents are evicted on each
+	// prune tick.
+	PrunePolicy PrunePolicy
+}
+
 // Service is interface to the torrent service.
 type Service struct {
 	client         *torrent.Client
 	embdEtcd       *etcd.EmbdEtcd
 	hostname       string
 	nodePath       string
-	dataDir        string
+	storage        StorageBackend
+	nat            *natTraversal
+	peerAuth       *peerAuth
+	completedAt    map[string]time.Time // torrent name -> when it finished
+	tombstoned     map[string]bool      // torrent name -> some node wants it gone everywhere
+	pruneStop      chan struct{}
 	nodesCancel    func()
 	torrentsCancel func()
 	actionChan     chan action
+	closing        chan struct{} // closed by Exit; lets blocked actionChan senders abort instead of racing its close
+	runDone        chan struct{} // closed once Run's mainloop returns
+
+	// Evictions reports every eviction the prune subsystem makes, so tests
+	// and other callers can observe what was evicted and why without
+	// scraping logs. Sends are non-blocking: a caller that isn't reading
+	// from it just misses the event.
+	Evictions chan EvictionEvent
 }
 
 type action func()
@@ -55,21 +110,47 @@ func (svc *Service) Exit() {
 		log.Printf("torrent: Failed to delete dht node %s: %s", svc.nodePath, err.Error())
 	}
 
+	// Close closing first so every blocked (or future) actionChan sender --
+	// the prune goroutine, torrentsChangeCallback's tombstone branch, and
+	// Evict -- aborts via its own select instead of racing an actionChan
+	// close. actionChan itself is never closed: it's written to by more
+	// than one goroutine, so closing it out from under a blocked send would
+	// panic.
+	close(svc.closing)
+
 	svc.nodesCancel()
 	svc.torrentsCancel()
 	svc.client.Close()
 
-	close(svc.actionChan)
+	if svc.pruneStop != nil {
+		close(svc.pruneStop)
+	}
+
+	if svc.peerAuth != nil {
+		svc.peerAuth.keysCancel()
+	}
+
+	if svc.nat != nil {
+		svc.nat.teardown()
+	}
+
+	// wait for Run's mainloop to finish whatever action it's currently
+	// executing (which may still be sending on Evictions) before closing
+	// it out from under that send.
+	<-svc.runDone
+	close(svc.Evictions)
 }
 
 // Run starts the mainloop of the torrent service.
 func (svc *Service) Run() {
+	defer close(svc.runDone)
 	for {
-		action := <-svc.actionChan
-		if action == nil {
+		select {
+		case action := <-svc.actionChan:
+			action()
+		case <-svc.closing:
 			return
 		}
-		action()
 	}
 }
 
@@ -96,9 +177,23 @@ func (svc *Service) torrentsChangeCallback(re *etcd.RE) error {
 	for _, event := range re.Response().Events {
 		switch event.Type {
 		case etcdClient.EventTypePut:
-			torrent, err := svc.client.AddMagnet(string(event.Kv.Value))
+			value := string(event.Kv.Value)
+			if value == "" {
+				// an empty value is a tombstone: some node wants this
+				// torrent gone everywhere. Record it and let the prune
+				// subsystem evict it on its next tick, alongside the other
+				// policy predicates, so PruneInterval's "zero disables
+				// pruning" contract also applies to tombstones.
+				name := path.Base(string(event.Kv.Key))
+				select {
+				case svc.actionChan <- func() { svc.tombstoned[name] = true }:
+				case <-svc.closing:
+				}
+				continue
+			}
+			torrent, err := svc.client.AddMagnet(value)
 			if err != nil {
-				log.Printf("Failed to get torrent from magnent link: %s Error: %s", string(event.Kv.Value), err.Error())
+				log.Printf("Failed to get torrent from magnent link: %s Error: %s", value, err.Error())
 				reterr = multierr.Append(reterr, err)
 			} else {
 				log.Printf("Initiating torrent download: %s", torrent.Name())
@@ -161,42 +256,120 @@ func (svc *Service) Add(torrentPath string) error {
 	return nil
 }
 
-// NewTorrentService create a new torrent service instance.
-func NewTorrentService(embdEtcd *etcd.EmbdEtcd, prefix, hostname string, isDebug bool) (svc *Service, err error) {
+// NewTorrentService is the sole constructor for a torrent Service; every
+// caller builds a Config and passes it in here rather than calling this with
+// positional arguments.
+func NewTorrentService(c *Config) (svc *Service, err error) {
 	svc = &Service{
-		actionChan: make(chan action),
-		embdEtcd:   embdEtcd,
+		actionChan:  make(chan action),
+		closing:     make(chan struct{}),
+		runDone:     make(chan struct{}),
+		embdEtcd:    c.EmbdEtcd,
+		hostname:    c.Hostname,
+		storage:     c.DefaultStorage,
+		completedAt: make(map[string]time.Time),
+		tombstoned:  make(map[string]bool),
+		Evictions:   make(chan EvictionEvent, 16),
 	}
-	addr, err := net.ResolveIPAddr("ip", hostname)
-	if err != nil {
-		log.Printf("torrent: Failed to resolve IP from hostname '%s': %s", hostname, err.Error())
-		return nil, err
+	var publicIP net.IP
+	if c.NATTraversal != "" && c.NATTraversal != NATOff {
+		nt, err := discoverNAT(c.NATTraversal, c.ListenPort)
+		if err != nil {
+			log.Printf("torrent: NAT traversal unavailable, falling back to hostname resolution: %s", err.Error())
+		} else {
+			svc.nat = nt
+			publicIP = nt.externalIP
+		}
+	}
+	if nat := svc.nat; nat != nil {
+		// discoverNAT already installed a live port mapping on the gateway;
+		// tear it back down on every error return below, since Exit only
+		// ever runs once NewTorrentService has returned a *Service. nat is
+		// captured here because each error return sets svc to nil.
+		defer func() {
+			if err != nil {
+				nat.teardown()
+			}
+		}()
 	}
 
-	svc.dataDir = path.Join(prefix, "torrent", "storage")
-	os.MkdirAll(svc.dataDir, 0644)
+	if publicIP == nil {
+		addr, err := net.ResolveIPAddr("ip", c.Hostname)
+		if err != nil {
+			log.Printf("torrent: Failed to resolve IP from hostname '%s': %s", c.Hostname, err.Error())
+			return nil, err
+		}
+		publicIP = addr.IP
+	}
+
+	if svc.storage == nil {
+		dataDir := path.Join(c.Prefix, "torrent", "storage")
+		svc.storage, err = NewFileStorage(dataDir)
+		if err != nil {
+			log.Printf("torrent: Failed to create storage dir '%s': %s", dataDir, err.Error())
+			return nil, err
+		}
+	}
 
 	cfg := &torrent.Config{
 		DHTConfig: dht.ServerConfig{
-			PublicIP: addr.IP,
+			PublicIP: publicIP,
+		},
+		Seed:  true,
+		Debug: c.Debug,
+		// Bind the fixed port whenever one is configured, not only when
+		// EncryptedPeers forces a listener -- NAT traversal maps and
+		// publishes c.ListenPort, so the client must actually listen there
+		// or every peer dialing the mapped address gets connection refused.
+		ListenPort: c.ListenPort,
+		// Route piece storage through the configured StorageBackend instead
+		// of a hardcoded directory, so DefaultStorage can be memory-backed
+		// or live outside of Prefix entirely.
+		TorrentDataOpener: func(info *metainfo.Info) torrent.Data {
+			data, err := svc.storage.OpenTorrent(info)
+			if err != nil {
+				log.Printf("torrent: Failed to open storage for '%s': %s", info.Name, err.Error())
+				return nil
+			}
+			return data
 		},
-		Seed:    true,
-		DataDir: svc.dataDir,
-		Debug:   isDebug,
+		DisableMetainfoCache: c.NoMetainfoCache,
+	}
+
+	var ln net.Listener
+	if c.EncryptedPeers {
+		svc.peerAuth, err = newPeerAuth(c.EmbdEtcd, c.Hostname)
+		if err != nil {
+			log.Printf("torrent: Failed to set up encrypted peers: %s", err.Error())
+			return nil, err
+		}
+
+		ln, err = net.Listen("tcp", fmt.Sprintf(":%d", c.ListenPort))
+		if err != nil {
+			log.Printf("torrent: Failed to listen on port %d for encrypted peers: %s", c.ListenPort, err.Error())
+			svc.peerAuth.keysCancel()
+			return nil, err
+		}
+		cfg.Listener = &secureListener{Listener: ln, pa: svc.peerAuth}
+		cfg.Dialer = &secureDialer{pa: svc.peerAuth}
 	}
 
 	svc.client, err = torrent.NewClient(cfg)
 	if err != nil {
 		log.Printf("torrent: Failed to create torrent client: %s", err.Error())
+		if ln != nil {
+			ln.Close()
+			svc.peerAuth.keysCancel()
+		}
 		return nil, err
 	}
 
-	svc.nodesCancel, err = embdEtcd.AddWatcher("/dht/nodes/", svc.nodeChangeCallback, false, true, etcdClient.WithPrefix())
+	svc.nodesCancel, err = svc.embdEtcd.AddWatcher("/dht/nodes/", svc.nodeChangeCallback, false, true, etcdClient.WithPrefix())
 	if err != nil {
 		log.Printf("torrent: Failed to add watcher for new nodes: %s", err.Error())
 		return nil, err
 	}
-	svc.torrentsCancel, err = embdEtcd.AddWatcher("/dht/torrents/", svc.torrentsChangeCallback, false, true, etcdClient.WithPrefix())
+	svc.torrentsCancel, err = svc.embdEtcd.AddWatcher("/dht/torrents/", svc.torrentsChangeCallback, false, true, etcdClient.WithPrefix())
 	if err != nil {
 		log.Printf("torrent: Failed to add watcher for new torrents: %s", err.Error())
 		svc.nodesCancel()
@@ -204,7 +377,7 @@ func NewTorrentService(embdEtcd *etcd.EmbdEtcd, prefix, hostname string, isDebug
 	}
 
 	// Only interested on success here
-	if values, err := embdEtcd.Get("/dht/nodes/"); err == nil {
+	if values, err := svc.embdEtcd.Get("/dht/nodes/"); err == nil {
 		nodes := []string{}
 		for _, v := range values {
 			nodes = append(nodes, v)
@@ -213,7 +386,16 @@ func NewTorrentService(embdEtcd *etcd.EmbdEtcd, prefix, hostname string, isDebug
 	}
 
 	svc.nodePath = fmt.Sprintf("/dht/nodes/%s", svc.hostname)
-	embdEtcd.Set(svc.nodePath, svc.client.ListenAddr().String())
+	nodeAddr := svc.client.ListenAddr().String()
+	if svc.nat != nil {
+		nodeAddr = fmt.Sprintf("%s:%d", svc.nat.externalIP.String(), c.ListenPort)
+		svc.nat.run(svc)
+	}
+	svc.embdEtcd.Set(svc.nodePath, nodeAddr)
+
+	if c.PruneInterval > 0 {
+		svc.startPrune(c.PruneInterval, c.PrunePolicy)
+	}
 
 	return
 }